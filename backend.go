@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ResolverBackend abstracts over the different ways godns can reach an
+// upstream: the miekg/dns client, Go's own net.Resolver, or the RFC
+// 8484 DoH client. Lookup races across backends the same way it used
+// to race across bare nameservers, without caring which protocol each
+// one speaks under the hood.
+type ResolverBackend interface {
+	// Exchange sends req to this backend's upstream and returns its
+	// response, honoring ctx's deadline/cancellation.
+	Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error)
+}
+
+// backendFactory builds a ResolverBackend bound to a single configured
+// upstream address. network is the "udp"/"tcp" the caller wants this
+// exchange carried over, same as Resolver.lookup's net parameter;
+// backends that don't have a meaningful choice of transport (DoH, DoT,
+// the golang backend) simply ignore it.
+type backendFactory func(upstream, network string, r *Resolver) ResolverBackend
+
+// backendFactories is keyed by the backend name used in the settings
+// file: "miekgdns" (default, the pre-existing client), "golang"
+// (net.Resolver with PreferGo), "doh" (RFC 8484) or "dot" (RFC 7858,
+// DNS-over-TLS).
+var backendFactories = map[string]backendFactory{
+	"miekgdns": newMiekgBackend,
+	"golang":   newGolangBackend,
+	"doh":      newDohBackend,
+	"dot":      newDotBackend,
+}
+
+// newBackend looks up the factory registered under name and builds a
+// backend for upstream, carrying network ("udp"/"tcp") through to
+// backends that care about transport. It falls back to "miekgdns" if
+// name is empty or not a registered backend, so existing configs keep
+// working unchanged.
+func newBackend(name, upstream, network string, r *Resolver) ResolverBackend {
+	factory, ok := backendFactories[name]
+	if !ok {
+		factory = backendFactories["miekgdns"]
+	}
+	return factory(upstream, network, r)
+}
+
+// backendFor returns the backend name configured for nameserver, or
+// "miekgdns" if none is configured.
+func (r *Resolver) backendFor(nameserver string) string {
+	if name, ok := settings.ResolvConfig.Backends[nameserver]; ok {
+		return name
+	}
+	return "miekgdns"
+}
+
+// miekgBackend wraps the original github.com/miekg/dns client.
+type miekgBackend struct {
+	client     *dns.Client
+	nameserver string
+}
+
+// newMiekgBackend carries network ("udp"/"tcp") straight through to the
+// dns.Client, the same way the pre-refactor Resolver set c.Net = net
+// itself - callers forwarding "tcp" (TCP-received queries, AXFR, ...)
+// still get a TCP upstream exchange, not just UDP.
+func newMiekgBackend(upstream, network string, r *Resolver) ResolverBackend {
+	if network != "tcp" {
+		network = ""
+	}
+	return &miekgBackend{
+		client: &dns.Client{
+			Net:          network,
+			ReadTimeout:  r.Timeout(),
+			WriteTimeout: r.Timeout(),
+		},
+		nameserver: upstream,
+	}
+}
+
+func (b *miekgBackend) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	m, _, err := b.client.ExchangeContext(ctx, req, b.nameserver)
+	return m, err
+}
+
+// golangBackend answers simple A/AAAA/CNAME queries using Go's own
+// net.Resolver (PreferGo), bypassing the miekg/dns client and cgo
+// resolver entirely. Anything else is unsupported - callers racing
+// several backends simply treat that as a failed upstream and fall
+// through to the next one.
+type golangBackend struct {
+	resolver *net.Resolver
+}
+
+// newGolangBackend pins the net.Resolver's dialer to upstream, the
+// same way bootstrapResolver.lookup pins its dialer to a bootstrap IP,
+// so a "golang"-backed entry actually queries the nameserver the admin
+// configured instead of silently falling back to the OS/Go default
+// resolver.
+func newGolangBackend(upstream, network string, r *Resolver) ResolverBackend {
+	addr := withDefaultPort(upstream, "53")
+	return &golangBackend{
+		resolver: &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				d := net.Dialer{Timeout: r.Timeout()}
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
+// withDefaultPort appends defaultPort to addr unless addr already
+// names one, accepting either the dnsmasq-style "host#port" separator
+// used by Resolver.Nameservers or the usual "host:port".
+func withDefaultPort(addr, defaultPort string) string {
+	if i := strings.IndexByte(addr, '#'); i > 0 {
+		return net.JoinHostPort(addr[:i], addr[i+1:])
+	}
+	if host, port, err := net.SplitHostPort(addr); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	return net.JoinHostPort(addr, defaultPort)
+}
+
+func (b *golangBackend) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("golang backend: expected exactly one question, got %d", len(req.Question))
+	}
+	q := req.Question[0]
+	name := UnFqdn(q.Name)
+
+	m := new(dns.Msg)
+	m.SetReply(req)
+
+	switch q.Qtype {
+	case dns.TypeA, dns.TypeAAAA:
+		addrs, err := b.resolver.LookupIPAddr(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			ip4 := addr.IP.To4()
+			if q.Qtype == dns.TypeA && ip4 != nil {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+					A:   ip4,
+				})
+			} else if q.Qtype == dns.TypeAAAA && ip4 == nil {
+				m.Answer = append(m.Answer, &dns.AAAA{
+					Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60},
+					AAAA: addr.IP,
+				})
+			}
+		}
+		return m, nil
+	case dns.TypeCNAME:
+		cname, err := b.resolver.LookupCNAME(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		m.Answer = append(m.Answer, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+			Target: dns.Fqdn(cname),
+		})
+		return m, nil
+	default:
+		return nil, fmt.Errorf("golang backend: unsupported qtype %s", dns.Type(q.Qtype).String())
+	}
+}
+
+// dohBackend wraps the RFC 8484 client so it can be raced against other
+// backends behind the same ResolverBackend interface.
+type dohBackend struct {
+	upstream string
+}
+
+func newDohBackend(upstream, network string, r *Resolver) ResolverBackend {
+	return &dohBackend{upstream: upstream}
+}
+
+func (b *dohBackend) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	return exchangeDoH(ctx, b.upstream, req)
+}
+
+// dotBackend speaks RFC 7858 DNS-over-TLS to upstream, using the
+// miekg/dns client's built-in "tcp-tls" transport.
+type dotBackend struct {
+	client     *dns.Client
+	nameserver string
+}
+
+func newDotBackend(upstream, network string, r *Resolver) ResolverBackend {
+	host, _, err := net.SplitHostPort(upstream)
+	if err != nil {
+		host = upstream
+	}
+	return &dotBackend{
+		client: &dns.Client{
+			Net:          "tcp-tls",
+			ReadTimeout:  r.Timeout(),
+			WriteTimeout: r.Timeout(),
+			TLSConfig:    &tls.Config{ServerName: host},
+		},
+		nameserver: withDefaultPort(upstream, "853"),
+	}
+}
+
+func (b *dotBackend) Exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	m, _, err := b.client.ExchangeContext(ctx, req, b.nameserver)
+	return m, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeTCPServer is an in-process DNS server reachable over TCP only,
+// used to prove a "tcp" network argument actually reaches the wire as
+// a TCP exchange rather than silently falling back to UDP.
+type fakeTCPServer struct {
+	addr   string
+	hits   int32
+	server *dns.Server
+}
+
+func newFakeTCPServer(t *testing.T) *fakeTCPServer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	fs := &fakeTCPServer{addr: ln.Addr().String()}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&fs.hits, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})
+
+	fs.server = &dns.Server{Listener: ln, Handler: mux}
+	go fs.server.ActivateAndServe()
+	t.Cleanup(func() { fs.server.Shutdown() })
+
+	return fs
+}
+
+func TestMiekgBackendExchange(t *testing.T) {
+	fast := newFakeServer(t, dns.RcodeSuccess, true)
+	r := newTestResolver(fast.nameserver())
+
+	// miekgBackend dials its nameserver as-is, so (unlike Resolver.Nameservers)
+	// it expects the usual "host:port" form rather than the "#"-separated one.
+	backend := newBackend("miekgdns", fast.addr, "udp", r)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	m, err := backend.Exchange(ctx, testQuery())
+	if err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("expected one answer RR, got %d", len(m.Answer))
+	}
+}
+
+// TestGolangBackendQueriesItsOwnUpstream checks that two golang-backed
+// entries pointed at different nameservers actually query those
+// different nameservers, instead of both collapsing onto whatever the
+// OS/Go default resolver is configured to use.
+func TestGolangBackendQueriesItsOwnUpstream(t *testing.T) {
+	first := newFakeServer(t, dns.RcodeSuccess, true)
+	second := newFakeServer(t, dns.RcodeSuccess, true)
+
+	r := newTestResolver(first.nameserver(), second.nameserver())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	backend := newBackend("golang", first.nameserver(), "udp", r)
+	if _, err := backend.Exchange(ctx, testQuery()); err != nil {
+		t.Fatalf("Exchange: %s", err)
+	}
+
+	// net.Resolver.LookupIPAddr issues both an A and an AAAA query under
+	// the hood, so the pinned upstream may see more than one hit - the
+	// regression this guards against is the *other* nameserver ever being
+	// contacted, which would mean the dialer wasn't actually pinned.
+	if hits := first.hitCount(); hits == 0 {
+		t.Fatal("expected the pinned upstream to be contacted at least once")
+	}
+	if hits := second.hitCount(); hits != 0 {
+		t.Fatalf("expected the other nameserver to never be contacted, got %d hits", hits)
+	}
+}
+
+// TestMiekgBackendHonorsTCPNetwork is a regression test for newMiekgBackend
+// forwarding the "tcp"/"udp" network argument to the dns.Client: a server
+// that only listens over TCP must still be reachable when the backend is
+// built with network "tcp".
+func TestMiekgBackendHonorsTCPNetwork(t *testing.T) {
+	fast := newFakeTCPServer(t)
+	r := newTestResolver(fast.addr)
+
+	backend := newBackend("miekgdns", fast.addr, "tcp", r)
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := backend.Exchange(ctx, testQuery()); err != nil {
+		t.Fatalf("Exchange over tcp: %s", err)
+	}
+	if hits := atomic.LoadInt32(&fast.hits); hits != 1 {
+		t.Fatalf("expected the TCP-only server to be hit once, got %d", hits)
+	}
+}
+
+func TestNewBackendFallsBackToMiekgdnsOnUnknownName(t *testing.T) {
+	fast := newFakeServer(t, dns.RcodeSuccess, true)
+	r := newTestResolver(fast.nameserver())
+
+	backend := newBackend("not-a-real-backend", fast.nameserver(), "udp", r)
+	if _, ok := backend.(*miekgBackend); !ok {
+		t.Fatalf("expected an unknown backend name to fall back to miekgBackend, got %T", backend)
+	}
+}
+
+func TestBackendFactoriesRegisterAllFourNames(t *testing.T) {
+	for _, name := range []string{"miekgdns", "golang", "doh", "dot"} {
+		if _, ok := backendFactories[name]; !ok {
+			t.Errorf("expected a registered backend factory for %q", name)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultMaxNegativeTTL is the RFC 2308 §5 suggested cap on how long a
+// negative answer may be cached for, used when settings.Cache doesn't
+// configure one explicitly.
+const defaultMaxNegativeTTL = 300
+
+// prefetchThreshold controls how early an about-to-expire entry is
+// refreshed in the background: once less than this fraction of its
+// original TTL remains, the next cache hit triggers a prefetch.
+const prefetchThreshold = 0.1
+
+// cacheKey identifies a cached answer by (qname, qtype, qclass), as
+// RFC 2308 / most resolver caches do.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+}
+
+func cacheKeyFor(req *dns.Msg) (cacheKey, bool) {
+	if len(req.Question) != 1 {
+		return cacheKey{}, false
+	}
+	q := req.Question[0]
+	return cacheKey{name: q.Name, qtype: q.Qtype, qclass: q.Qclass}, true
+}
+
+// cacheEntry holds a cached answer together with the bookkeeping needed
+// to decrement its TTL on serve and expire/prefetch it at the right
+// time.
+type cacheEntry struct {
+	msg         *dns.Msg
+	negative    bool
+	originalTTL uint32
+	storedAt    time.Time
+
+	prefetching int32 // atomic bool, guards against duplicate prefetches
+}
+
+func (e *cacheEntry) remainingTTL(now time.Time) int64 {
+	elapsed := int64(now.Sub(e.storedAt).Seconds())
+	return int64(e.originalTTL) - elapsed
+}
+
+// answerCache is an in-memory cache sitting in front of
+// Resolver.Lookup/Resolver.LookupHttp, keyed by (qname, qtype, qclass).
+// Positive answers are cached for the minimum RR TTL in the message;
+// negative answers (NXDOMAIN, or NOERROR with no matching records) are
+// cached for the SOA MINIMUM from the authority section, capped at
+// MaxNegativeTTL, per RFC 2308.
+type answerCache struct {
+	mu      sync.RWMutex
+	entries map[cacheKey]*cacheEntry
+
+	maxNegativeTTL uint32
+
+	hits, misses uint64
+}
+
+func newAnswerCache(maxNegativeTTL uint32) *answerCache {
+	if maxNegativeTTL == 0 {
+		maxNegativeTTL = defaultMaxNegativeTTL
+	}
+	return &answerCache{
+		entries:        make(map[cacheKey]*cacheEntry),
+		maxNegativeTTL: maxNegativeTTL,
+	}
+}
+
+// get returns a copy of the cached answer for req with every answer
+// RR's TTL set to the entry's remaining lifetime (its minimum answer
+// TTL less however long it has sat in the cache; a negative answer's
+// records keep the TTLs they were stored with), and
+// triggers a background prefetch via refresh if the entry is close to
+// expiring. It returns ok=false on a miss or once the entry has
+// expired.
+func (c *answerCache) get(req *dns.Msg, refresh func()) (msg *dns.Msg, ok bool) {
+	key, ok := cacheKeyFor(req)
+	if !ok {
+		return nil, false
+	}
+
+	c.mu.RLock()
+	entry, found := c.entries[key]
+	c.mu.RUnlock()
+
+	if !found {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	remaining := entry.remainingTTL(time.Now())
+	if remaining <= 0 {
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+
+	atomic.AddUint64(&c.hits, 1)
+
+	if float64(remaining) < float64(entry.originalTTL)*prefetchThreshold {
+		if atomic.CompareAndSwapInt32(&entry.prefetching, 0, 1) {
+			go refresh()
+		}
+	}
+
+	out := entry.msg.Copy()
+	out.Id = req.Id
+	if !entry.negative {
+		for _, rr := range out.Answer {
+			rr.Header().Ttl = uint32(remaining)
+		}
+	}
+	return out, true
+}
+
+// store caches msg for req, using the minimum answer TTL for positive
+// responses and the SOA MINIMUM (capped by maxNegativeTTL) for negative
+// ones. Responses that aren't cacheable (truncated, SERVFAIL, etc.) are
+// ignored.
+func (c *answerCache) store(req, msg *dns.Msg) {
+	if msg == nil || msg.Truncated {
+		return
+	}
+
+	key, ok := cacheKeyFor(req)
+	if !ok {
+		return
+	}
+
+	negative := isNegativeAnswer(msg)
+	var ttl uint32
+	if negative {
+		if msg.Rcode == dns.RcodeServerFailure {
+			return
+		}
+		soaMin, ok := soaMinimum(msg)
+		if !ok {
+			return
+		}
+		ttl = soaMin
+		if ttl > c.maxNegativeTTL {
+			ttl = c.maxNegativeTTL
+		}
+	} else {
+		ttl = minAnswerTTL(msg)
+	}
+	if ttl == 0 {
+		return
+	}
+
+	entry := &cacheEntry{
+		msg:         msg.Copy(),
+		negative:    negative,
+		originalTTL: ttl,
+		storedAt:    time.Now(),
+	}
+
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+}
+
+// flush empties the cache. Exposed for a runtime flush API (e.g. an
+// admin endpoint or signal handler).
+func (c *answerCache) flush() {
+	c.mu.Lock()
+	c.entries = make(map[cacheKey]*cacheEntry)
+	c.mu.Unlock()
+}
+
+// size, hitCount and missCount back the cache's runtime metrics.
+func (c *answerCache) size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.entries)
+}
+
+func (c *answerCache) hitCount() uint64 {
+	return atomic.LoadUint64(&c.hits)
+}
+
+func (c *answerCache) missCount() uint64 {
+	return atomic.LoadUint64(&c.misses)
+}
+
+// isNegativeAnswer reports whether msg is a negative response: NXDOMAIN,
+// or NOERROR with no answers (RFC 2308 §2.1/§2.2).
+func isNegativeAnswer(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+	return msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0
+}
+
+// minAnswerTTL returns the smallest RR TTL across msg's answer section,
+// which is the safe TTL to cache a positive answer for.
+func minAnswerTTL(msg *dns.Msg) uint32 {
+	var min uint32
+	for i, rr := range msg.Answer {
+		ttl := rr.Header().Ttl
+		if i == 0 || ttl < min {
+			min = ttl
+		}
+	}
+	return min
+}
+
+// soaMinimum returns the MINIMUM field of the SOA record in msg's
+// authority section, which RFC 2308 designates as the negative caching
+// TTL.
+func soaMinimum(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Minttl, true
+		}
+	}
+	return 0, false
+}
+
+// cachedLookup serves req from cache when possible, otherwise delegates
+// to lookup (either Resolver.Lookup or Resolver.LookupHttp) and caches
+// a cacheable result before returning it.
+func (c *answerCache) cachedLookup(ctx context.Context, req *dns.Msg, lookup func(context.Context, *dns.Msg) (*dns.Msg, error)) (*dns.Msg, error) {
+	refresh := func() {
+		refreshCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if msg, err := lookup(refreshCtx, req); err == nil {
+			c.store(req, msg)
+		}
+	}
+
+	if msg, ok := c.get(req, refresh); ok {
+		return msg, nil
+	}
+
+	msg, err := lookup(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	c.store(req, msg)
+	return msg, nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// CacheStats is the JSON-serializable snapshot returned by the cache's
+// runtime metrics endpoint.
+type CacheStats struct {
+	Size   int    `json:"size"`
+	Hits   uint64 `json:"hits"`
+	Misses uint64 `json:"misses"`
+}
+
+// Stats returns a snapshot of the cache's current size and hit/miss
+// counters.
+func (c *answerCache) Stats() CacheStats {
+	return CacheStats{Size: c.size(), Hits: c.hitCount(), Misses: c.missCount()}
+}
+
+// ServeHTTP implements http.Handler, exposing the cache's runtime
+// metrics on GET and a flush on POST, so an operator can mount it on
+// whatever admin mux the server already runs (e.g.
+// mux.Handle("/cache", resolver.CacheHandler())).
+func (c *answerCache) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Stats())
+	case http.MethodPost:
+		c.flush()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// CacheHandler exposes r's answer cache as an http.Handler: GET returns
+// its size/hit/miss metrics as JSON, POST flushes it. Returns nil if
+// caching isn't enabled on r.
+func (r *Resolver) CacheHandler() http.Handler {
+	if r.cache == nil {
+		return nil
+	}
+	return r.cache
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestCacheHandlerServesStatsAndFlush(t *testing.T) {
+	r := NewResolver(&dns.ClientConfig{Servers: []string{"127.0.0.1#1"}, Port: "53", Timeout: 1})
+	handler := r.CacheHandler()
+	if handler == nil {
+		t.Fatal("expected a non-nil cache handler on a resolver built with NewResolver")
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	r.cache.store(req, positiveAnswer(300))
+	if _, ok := r.cache.get(req, func() {}); !ok {
+		t.Fatal("expected a cache hit before querying the admin endpoint")
+	}
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/cache", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 from GET, got %d", rr.Code)
+	}
+	var stats CacheStats
+	if err := json.NewDecoder(rr.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode stats: %s", err)
+	}
+	if stats.Size != 1 || stats.Hits != 1 {
+		t.Fatalf("expected size=1 hits=1, got %+v", stats)
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/cache", nil))
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 from POST flush, got %d", rr.Code)
+	}
+	if r.cache.size() != 0 {
+		t.Fatalf("expected the cache to be empty after a POST flush, got size %d", r.cache.size())
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/cache", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expected 405 for an unsupported method, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func positiveAnswer(ttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   []byte{127, 0, 0, 1},
+	})
+	return m
+}
+
+func nxdomainAnswer(soaMinimum uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: dns.Fqdn("example.com"), Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Minttl: soaMinimum,
+	})
+	return m
+}
+
+func TestAnswerCachePositiveHitDecrementsTTL(t *testing.T) {
+	c := newAnswerCache(0)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	c.store(req, positiveAnswer(300))
+	c.entries[cacheKey{name: dns.Fqdn("example.com"), qtype: dns.TypeA, qclass: dns.ClassINET}].storedAt = time.Now().Add(-100 * time.Second)
+
+	msg, ok := c.get(req, func() {})
+	if !ok {
+		t.Fatal("expected a cache hit")
+	}
+	if ttl := msg.Answer[0].Header().Ttl; ttl != 200 {
+		t.Fatalf("expected the TTL to be decremented from 300 to 200 after 100s in the cache, got %d", ttl)
+	}
+	if c.hitCount() != 1 || c.missCount() != 0 {
+		t.Fatalf("expected 1 hit/0 miss, got %d/%d", c.hitCount(), c.missCount())
+	}
+}
+
+func TestAnswerCacheNegativeCappedByMaxNegativeTTL(t *testing.T) {
+	c := newAnswerCache(60)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	c.store(req, nxdomainAnswer(3600))
+	entry := c.entries[cacheKey{name: dns.Fqdn("example.com"), qtype: dns.TypeA, qclass: dns.ClassINET}]
+	if entry == nil || entry.originalTTL != 60 {
+		t.Fatalf("expected the SOA MINIMUM of 3600 to be capped to 60, got entry %+v", entry)
+	}
+
+	msg, ok := c.get(req, func() {})
+	if !ok {
+		t.Fatal("expected a cache hit for the negative answer")
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN to be preserved, got rcode %d", msg.Rcode)
+	}
+}
+
+func TestAnswerCacheMissAfterFlush(t *testing.T) {
+	c := newAnswerCache(0)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	c.store(req, positiveAnswer(300))
+	if _, ok := c.get(req, func() {}); !ok {
+		t.Fatal("expected a cache hit before flush")
+	}
+
+	c.flush()
+
+	if _, ok := c.get(req, func() {}); ok {
+		t.Fatal("expected a cache miss after flush")
+	}
+	if c.size() != 0 {
+		t.Fatalf("expected an empty cache after flush, got size %d", c.size())
+	}
+}
+
+func TestAnswerCacheExpiredEntryIsEvicted(t *testing.T) {
+	c := newAnswerCache(0)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	c.store(req, positiveAnswer(1))
+	c.entries[cacheKey{name: dns.Fqdn("example.com"), qtype: dns.TypeA, qclass: dns.ClassINET}].storedAt = time.Now().Add(-2 * time.Second)
+
+	if _, ok := c.get(req, func() {}); ok {
+		t.Fatal("expected the expired entry to be treated as a miss")
+	}
+	if c.size() != 0 {
+		t.Fatalf("expected the expired entry to be evicted, got size %d", c.size())
+	}
+}
+
+// TestResolverLookupServesSecondQueryFromCache exercises the cache
+// through Resolver.Lookup end-to-end (NewResolver's real wiring), not
+// just through answerCache directly, to make sure a Resolver built the
+// way production code builds one actually caches.
+func TestResolverLookupServesSecondQueryFromCache(t *testing.T) {
+	fast := newFakeServer(t, dns.RcodeSuccess, true)
+
+	r := NewResolver(&dns.ClientConfig{Servers: []string{fast.nameserver()}, Port: "53", Timeout: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := r.Lookup(ctx, "udp", testQuery()); err != nil {
+		t.Fatalf("first Lookup: %s", err)
+	}
+	if _, err := r.Lookup(ctx, "udp", testQuery()); err != nil {
+		t.Fatalf("second Lookup: %s", err)
+	}
+
+	if hits := fast.hitCount(); hits != 1 {
+		t.Fatalf("expected the nameserver to be hit once and the second query served from cache, got %d hits", hits)
+	}
+	if r.cache.hitCount() != 1 {
+		t.Fatalf("expected exactly one cache hit, got %d", r.cache.hitCount())
+	}
+}
+
+func TestCachedLookupServesFromCacheOnSecondCall(t *testing.T) {
+	c := newAnswerCache(0)
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+
+	calls := 0
+	lookup := func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		calls++
+		return positiveAnswer(300), nil
+	}
+
+	if _, err := c.cachedLookup(context.Background(), req, lookup); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := c.cachedLookup(context.Background(), req, lookup); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected the second call to be served from cache, lookup ran %d times", calls)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the wire format mandated by RFC 8484.
+const dohMediaType = "application/dns-message"
+
+// dohClient is shared across all DoH exchanges so TCP/TLS connections get
+// pooled instead of being re-established on every lookup. Its transport
+// dials through the bootstrap resolver (when configured) so resolving
+// the DoH server's own hostname never depends on the OS resolver -
+// important since godns may itself be configured as that OS resolver.
+// It is built lazily, on first use, since settings isn't populated yet
+// at package init time.
+var (
+	dohClientOnce sync.Once
+	dohClient     *http.Client
+)
+
+func getDohClient() *http.Client {
+	dohClientOnce.Do(func() {
+		dohClient = &http.Client{
+			Timeout:   time.Duration(settings.Http.Timeout) * time.Second,
+			Transport: dohTransport(newBootstrapResolver(settings.Http.Bootstrap)),
+		}
+	})
+	return dohClient
+}
+
+// LookupHttp serves req from the answer cache when possible, otherwise
+// resolves it against the configured DoH upstream(s) and caches the
+// result - see lookupHttp for the uncached implementation.
+func (r *Resolver) LookupHttp(ctx context.Context, net string, req *dns.Msg) (message *dns.Msg, err error) {
+	if r.cache == nil {
+		return r.lookupHttp(ctx, net, req)
+	}
+	return r.cache.cachedLookup(ctx, req, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		return r.lookupHttp(ctx, net, req)
+	})
+}
+
+// lookupHttp resolves req against the configured DoH upstream(s) using
+// RFC 8484, racing them the same way Lookup races plain UDP/TCP
+// nameservers, and returns the first usable answer. As soon as one
+// upstream answers, ctx is canceled so the HTTP requests still in
+// flight on the others are aborted instead of running to completion.
+func (r *Resolver) lookupHttp(ctx context.Context, net string, req *dns.Msg) (message *dns.Msg, err error) {
+	if len(req.Question) == 0 {
+		return nil, fmt.Errorf("doh: message has no question")
+	}
+
+	upstreams := r.httpUpstreams()
+	if len(upstreams) == 0 {
+		return nil, ResolvError{req.Question[0].Name, "https", nil}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	qname := req.Question[0].Name
+	res := make(chan *dns.Msg, 1)
+	var wg sync.WaitGroup
+	L := func(upstream string) {
+		defer wg.Done()
+		m, err := exchangeDoH(ctx, upstream, req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			logger.Warn("%s doh error on %s", qname, upstream)
+			logger.Warn("error:%s", err.Error())
+			return
+		}
+		// Same fail-fast rule as Resolver.lookup: SERVFAIL/FORMERR mean
+		// this upstream couldn't answer, so fall through to the next
+		// one; any other non-success rcode is authoritative enough to
+		// return straight away.
+		if m != nil && m.Rcode != dns.RcodeSuccess {
+			logger.Warn("%s doh failed to get a valid answer on %s", qname, upstream)
+			if isRetryableRcode(m.Rcode) {
+				return
+			}
+		}
+		select {
+		case res <- m:
+		default:
+		}
+	}
+
+	ticker := time.NewTicker(time.Duration(settings.ResolvConfig.Interval) * time.Millisecond)
+	defer ticker.Stop()
+	for _, upstream := range upstreams {
+		wg.Add(1)
+		go L(upstream)
+		// An answer may already be sitting in res by the time the ticker
+		// also fires; check it first, non-blocking, the same way
+		// Resolver.lookup does, so a ready answer always wins the race.
+		select {
+		case m := <-res:
+			return m, nil
+		default:
+		}
+		select {
+		case m := <-res:
+			return m, nil
+		case <-ticker.C:
+			continue
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
+		}
+	}
+	wg.Wait()
+	select {
+	case m := <-res:
+		return m, nil
+	default:
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ResolvError{qname, "https", upstreams}
+	}
+}
+
+// httpUpstreams returns the configured DoH upstream URLs, e.g.
+// "https://1.1.1.1/dns-query" or "https://dns.google/dns-query". It
+// falls back to settings.Http.Remote alone, used as the full DoH query
+// URL, for backward compatibility with the old single-upstream config.
+func (r *Resolver) httpUpstreams() []string {
+	if len(settings.Http.Upstreams) > 0 {
+		return settings.Http.Upstreams
+	}
+	if settings.Http.Remote != "" {
+		return []string{settings.Http.Remote}
+	}
+	return nil
+}
+
+// exchangeDoH performs a single RFC 8484 exchange against upstream, a
+// full DoH query URL. It POSTs the raw wire message with the mandated
+// content and accept headers, then honors any Cache-Control: max-age
+// the server returned by overriding the answer's RR TTLs.
+func exchangeDoH(ctx context.Context, upstream string, req *dns.Msg) (*dns.Msg, error) {
+	wire, err := req.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream, bytes.NewReader(wire))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", dohMediaType)
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	resp, err := getDohClient().Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: unexpected status %d from %s", resp.StatusCode, upstream)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	if err := m.Unpack(body); err != nil {
+		return nil, err
+	}
+	m.Id = req.Id
+
+	if ttl, ok := maxAgeTTL(resp.Header.Get("Cache-Control")); ok {
+		applyCacheControlTTL(m, ttl)
+	}
+
+	return m, nil
+}
+
+// maxAgeTTL extracts the max-age directive from a Cache-Control header,
+// as returned by DoH servers to tell the client how long the answer may
+// be cached for.
+func maxAgeTTL(cacheControl string) (ttl uint32, ok bool) {
+	for _, part := range strings.Split(cacheControl, ",") {
+		part = strings.TrimSpace(part)
+		if !strings.HasPrefix(part, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.ParseUint(strings.TrimPrefix(part, "max-age="), 10, 32)
+		if err != nil {
+			continue
+		}
+		return uint32(seconds), true
+	}
+	return 0, false
+}
+
+// applyCacheControlTTL overrides every answer RR's TTL with ttl, so the
+// HTTP-layer freshness the DoH server advertised takes precedence over
+// whatever TTL happened to be wire-encoded in the DNS message.
+func applyCacheControlTTL(m *dns.Msg, ttl uint32) {
+	for _, rr := range m.Answer {
+		rr.Header().Ttl = ttl
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// bootstrapTTL is how long a bootstrap-resolved IP is trusted before it
+// is refreshed in the background. DoH upstream hostnames rarely move,
+// so this is generous on purpose.
+const bootstrapTTL = 10 * time.Minute
+
+// bootstrapResolver resolves DoH upstream hostnames (e.g. "dns.google")
+// using a fixed set of literal IPs, never the OS resolver. This avoids
+// the loop/breakage that happens when godns is itself the system
+// resolver: the OS resolver would have to ask godns, which would have
+// to ask the OS resolver to find the DoH server, forever.
+type bootstrapResolver struct {
+	ips []string
+
+	mu    sync.RWMutex
+	cache map[string]bootstrapEntry
+}
+
+type bootstrapEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+// newBootstrapResolver builds a bootstrapResolver from the literal IPs
+// configured in settings.Http.Bootstrap. It returns nil if none are
+// configured, so dohTransport can fall back to the default dialer.
+func newBootstrapResolver(ips []string) *bootstrapResolver {
+	if len(ips) == 0 {
+		return nil
+	}
+	return &bootstrapResolver{
+		ips:   ips,
+		cache: make(map[string]bootstrapEntry),
+	}
+}
+
+// resolve returns a cached address for host, refreshing it in the
+// background once it is past its TTL, or performs a synchronous lookup
+// on first use.
+func (b *bootstrapResolver) resolve(ctx context.Context, host string) (string, error) {
+	b.mu.RLock()
+	entry, ok := b.cache[host]
+	b.mu.RUnlock()
+
+	if ok {
+		if time.Now().After(entry.expires) {
+			go b.refresh(host)
+		}
+		return entry.addrs[rand.Intn(len(entry.addrs))], nil
+	}
+
+	addrs, err := b.lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	b.store(host, addrs)
+	return addrs[rand.Intn(len(addrs))], nil
+}
+
+// refresh re-resolves host against the bootstrap servers and updates
+// the cache, swallowing errors since a stale-but-present entry is still
+// usable until the next refresh succeeds.
+func (b *bootstrapResolver) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := b.lookup(ctx, host)
+	if err != nil {
+		logger.Warn("bootstrap: failed to refresh %s: %s", host, err.Error())
+		return
+	}
+	b.store(host, addrs)
+}
+
+func (b *bootstrapResolver) store(host string, addrs []string) {
+	b.mu.Lock()
+	b.cache[host] = bootstrapEntry{addrs: addrs, expires: time.Now().Add(bootstrapTTL)}
+	b.mu.Unlock()
+}
+
+// lookup asks each configured bootstrap IP in turn for host's addresses
+// (IPv4 and IPv6, via net.Resolver.LookupHost),
+// using a throwaway net.Resolver pinned to that single server. Each
+// entry in b.ips may be a bare IP (port 53 is assumed) or use the same
+// "ip#port" separator as Resolver.Nameservers, which is mainly useful
+// for pointing tests at an in-process fake server on a random port.
+func (b *bootstrapResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	var lastErr error
+	for _, bootstrapIP := range b.ips {
+		addr := withDefaultPort(bootstrapIP, "53")
+		r := &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				d := net.Dialer{Timeout: 5 * time.Second}
+				return d.DialContext(ctx, network, addr)
+			},
+		}
+		addrs, err := r.LookupHost(ctx, host)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(addrs) > 0 {
+			return addrs, nil
+		}
+	}
+	return nil, lastErr
+}
+
+// dohTransport builds an *http.Transport whose DialContext consults the
+// bootstrap resolver (if configured) to resolve the DoH server's
+// hostname, instead of letting net/http fall through to the OS
+// resolver.
+func dohTransport(bootstrap *bootstrapResolver) *http.Transport {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	return &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if bootstrap == nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			if net.ParseIP(host) != nil {
+				return dialer.DialContext(ctx, network, addr)
+			}
+			ip, err := bootstrap.resolve(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		},
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dohTestServer starts an httptest.Server that answers every RFC 8484
+// POST with a packed dns.Msg built from build(req), optionally setting
+// a Cache-Control header.
+func dohTestServer(t *testing.T, cacheControl string, build func(req *dns.Msg) *dns.Msg) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		req := new(dns.Msg)
+		if err := req.Unpack(body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		resp := build(req)
+		wire, err := resp.Pack()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if cacheControl != "" {
+			w.Header().Set("Cache-Control", cacheControl)
+		}
+		w.Header().Set("Content-Type", dohMediaType)
+		w.Write(wire)
+	}))
+}
+
+func testDoHQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	return req
+}
+
+func TestExchangeDoHAppliesCacheControlTTL(t *testing.T) {
+	srv := dohTestServer(t, "max-age=42", func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   []byte{127, 0, 0, 1},
+		})
+		return m
+	})
+	defer srv.Close()
+
+	m, err := exchangeDoH(context.Background(), srv.URL, testDoHQuery())
+	if err != nil {
+		t.Fatalf("exchangeDoH: %s", err)
+	}
+	if len(m.Answer) != 1 {
+		t.Fatalf("expected one answer RR, got %d", len(m.Answer))
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 42 {
+		t.Fatalf("expected Cache-Control max-age to override the TTL to 42, got %d", ttl)
+	}
+}
+
+func TestExchangeDoHWithoutCacheControlKeepsWireTTL(t *testing.T) {
+	srv := dohTestServer(t, "", func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+			A:   []byte{127, 0, 0, 1},
+		})
+		return m
+	})
+	defer srv.Close()
+
+	m, err := exchangeDoH(context.Background(), srv.URL, testDoHQuery())
+	if err != nil {
+		t.Fatalf("exchangeDoH: %s", err)
+	}
+	if ttl := m.Answer[0].Header().Ttl; ttl != 3600 {
+		t.Fatalf("expected the wire TTL to be preserved, got %d", ttl)
+	}
+}
+
+func TestMaxAgeTTL(t *testing.T) {
+	cases := []struct {
+		header  string
+		wantTTL uint32
+		wantOK  bool
+	}{
+		{"max-age=300", 300, true},
+		{"private, max-age=60", 60, true},
+		{"no-cache", 0, false},
+		{"", 0, false},
+	}
+	for _, tc := range cases {
+		ttl, ok := maxAgeTTL(tc.header)
+		if ok != tc.wantOK || ttl != tc.wantTTL {
+			t.Errorf("maxAgeTTL(%q) = (%d, %v), want (%d, %v)", tc.header, ttl, ok, tc.wantTTL, tc.wantOK)
+		}
+	}
+}
+
+// TestLookupHttpRetriesOnServfail mirrors resolver_test.go's
+// TestLookupRetriesOnServfail: a SERVFAIL from the fastest upstream
+// must not be returned to the caller - LookupHttp should fall through
+// to the next configured upstream.
+func TestLookupHttpRetriesOnServfail(t *testing.T) {
+	broken := dohTestServer(t, "", func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = dns.RcodeServerFailure
+		return m
+	})
+	defer broken.Close()
+
+	good := dohTestServer(t, "", func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   []byte{127, 0, 0, 1},
+		})
+		return m
+	})
+	defer good.Close()
+
+	settings.Http.Upstreams = []string{broken.URL, good.URL}
+	defer func() { settings.Http.Upstreams = nil }()
+
+	r := &Resolver{}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	msg, err := r.LookupHttp(ctx, "https", testDoHQuery())
+	if err != nil {
+		t.Fatalf("LookupHttp returned error: %s", err)
+	}
+	if msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected rcode success from the good upstream, got %d", msg.Rcode)
+	}
+	if len(msg.Answer) != 1 {
+		t.Fatalf("expected the answer from the good upstream, got %d RRs", len(msg.Answer))
+	}
+}
+
+// TestLookupHttpRejectsQuestionlessMessage is a regression test: a
+// crafted message with QDCOUNT=0 must return an error, not panic on
+// req.Question[0].
+func TestLookupHttpRejectsQuestionlessMessage(t *testing.T) {
+	r := &Resolver{}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if _, err := r.LookupHttp(ctx, "https", new(dns.Msg)); err == nil {
+		t.Fatal("expected an error for a message with no question")
+	}
+}
+
+// TestLookupHttpNegativeAnswerStillReturnedImmediately checks that a
+// terminal (non-retryable) rcode such as NXDOMAIN is still returned
+// straight away, without trying the second upstream.
+func TestLookupHttpNegativeAnswerStillReturnedImmediately(t *testing.T) {
+	nx := dohTestServer(t, "", func(req *dns.Msg) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = dns.RcodeNameError
+		return m
+	})
+	defer nx.Close()
+
+	var secondHit bool
+	second := dohTestServer(t, "", func(req *dns.Msg) *dns.Msg {
+		secondHit = true
+		m := new(dns.Msg)
+		m.SetReply(req)
+		return m
+	})
+	defer second.Close()
+
+	settings.Http.Upstreams = []string{nx.URL, second.URL}
+	defer func() { settings.Http.Upstreams = nil }()
+
+	r := &Resolver{}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	msg, err := r.LookupHttp(ctx, "https", testDoHQuery())
+	if err != nil {
+		t.Fatalf("LookupHttp returned error: %s", err)
+	}
+	if msg.Rcode != dns.RcodeNameError {
+		t.Fatalf("expected NXDOMAIN, got rcode %d", msg.Rcode)
+	}
+	if secondHit {
+		t.Fatal("expected the second upstream to never be dispatched")
+	}
+}
@@ -1,14 +1,11 @@
 package main
 
 import (
-	"encoding/base64"
-	"errors"
+	"context"
 	"fmt"
 	"strings"
 	"sync"
 	"time"
-	"net/http"
-    "io/ioutil"
 
 	"github.com/miekg/dns"
 )
@@ -25,103 +22,134 @@ func (e ResolvError) Error() string {
 
 type Resolver struct {
 	config *dns.ClientConfig
+	cache  *answerCache
 }
 
-// Lookup will ask each nameserver in top-to-bottom fashion, starting a new request
-// in every second, and return as early as possbile (have an answer).
-// It returns an error if no request has succeeded.
-func (r *Resolver) Lookup(net string, req *dns.Msg) (message *dns.Msg, err error) {
-	c := &dns.Client{
-		Net:          net,
-		ReadTimeout:  r.Timeout(),
-		WriteTimeout: r.Timeout(),
+// NewResolver builds a Resolver around the parsed resolv.conf-style
+// config, with the in-memory answer cache enabled using
+// settings.Cache.MaxNegativeTTL as its RFC 2308 negative-TTL cap.
+func NewResolver(config *dns.ClientConfig) *Resolver {
+	return &Resolver{
+		config: config,
+		cache:  newAnswerCache(settings.Cache.MaxNegativeTTL),
 	}
+}
 
+// Lookup serves req from the answer cache when possible, otherwise
+// dispatches it across the configured nameservers and caches the
+// result - see lookup for the uncached implementation.
+func (r *Resolver) Lookup(ctx context.Context, net string, req *dns.Msg) (message *dns.Msg, err error) {
+	if r.cache == nil {
+		return r.lookup(ctx, net, req)
+	}
+	return r.cache.cachedLookup(ctx, req, func(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+		return r.lookup(ctx, net, req)
+	})
+}
+
+// lookup will ask each nameserver in top-to-bottom fashion, starting a new request
+// every settings.ResolvConfig.Interval milliseconds, and return as early as possbile (have an answer).
+// It returns an error if no request has succeeded, or if ctx is done
+// first. Each nameserver is dispatched through whichever ResolverBackend
+// is configured for it (miekg/dns by default), so plain UDP/TCP
+// servers, Go's net.Resolver and DoH/DoT upstreams can all be raced
+// side by side. As soon as a usable answer arrives, ctx is canceled so
+// the exchanges still in flight on the other nameservers are torn down
+// instead of running to their own timeouts.
+func (r *Resolver) lookup(ctx context.Context, net string, req *dns.Msg) (message *dns.Msg, err error) {
 	qname := req.Question[0].Name
 
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	res := make(chan *dns.Msg, 1)
 	var wg sync.WaitGroup
 	L := func(nameserver string) {
 		defer wg.Done()
-		r, rtt, err := c.Exchange(req, nameserver)
+		backend := newBackend(r.backendFor(nameserver), nameserver, net, r)
+		m, err := backend.Exchange(ctx, req)
 		if err != nil {
+			if ctx.Err() != nil {
+				// canceled because another nameserver already answered.
+				return
+			}
 			logger.Warn("%s socket error on %s", qname, nameserver)
 			logger.Warn("error:%s", err.Error())
 			return
 		}
-		// If SERVFAIL happen, should return immediately and try another upstream resolver.
-		// However, other Error code like NXDOMAIN is an clear response stating
-		// that it has been verified no such domain existas and ask other resolvers
-		// would make no sense. See more about #20
-		if r != nil && r.Rcode != dns.RcodeSuccess {
+		// If SERVFAIL or FORMERR happen, fall through and try another
+		// upstream resolver - those rcodes mean *this* server couldn't
+		// answer, not that the name doesn't exist. Any other non-success
+		// rcode (NXDOMAIN, REFUSED, ...) and a NOERROR with zero matching
+		// answers are authoritative enough that asking another resolver
+		// would make no sense, so those are returned immediately instead.
+		// See more about #20.
+		if m != nil && m.Rcode != dns.RcodeSuccess {
 			logger.Warn("%s failed to get an valid answer on %s", qname, nameserver)
-			if r.Rcode == dns.RcodeServerFailure {
+			if isRetryableRcode(m.Rcode) {
 				return
 			}
 		} else {
-			logger.Debug("%s resolv on %s (%s) ttl: %d", UnFqdn(qname), nameserver, net, rtt)
+			logger.Debug("%s resolv on %s (%s)", UnFqdn(qname), nameserver, net)
 		}
 		select {
-		case res <- r:
+		case res <- m:
 		default:
 		}
 	}
 
 	ticker := time.NewTicker(time.Duration(settings.ResolvConfig.Interval) * time.Millisecond)
 	defer ticker.Stop()
+	nameservers := r.Nameservers()
 	// Start lookup on each nameserver top-down, in every second
-	for _, nameserver := range r.Nameservers() {
+	for _, nameserver := range nameservers {
 		wg.Add(1)
 		go L(nameserver)
+		// An answer may already be sitting in res by the time the ticker
+		// also fires; check it first, non-blocking, so a ready answer
+		// always wins the race instead of occasionally losing it to the
+		// ticker and dispatching one nameserver too many.
+		select {
+		case m := <-res:
+			return m, nil
+		default:
+		}
 		// but exit early, if we have an answer
 		select {
-		case r := <-res:
-			return r, nil
+		case m := <-res:
+			return m, nil
 		case <-ticker.C:
 			continue
+		case <-ctx.Done():
+			wg.Wait()
+			return nil, ctx.Err()
 		}
 	}
 	// wait for all the namservers to finish
 	wg.Wait()
 	select {
-	case r := <-res:
-		return r, nil
+	case m := <-res:
+		return m, nil
 	default:
-		return nil, ResolvError{qname, net, r.Nameservers()}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, ResolvError{qname, net, nameservers}
 	}
-
 }
 
-func (r *Resolver) LookupHttp(net string, req *dns.Msg) (message *dns.Msg, err error) {
-	if len(req.Question) > 0 {
-		q := req.Question[0]
-		url := []string{settings.Http.Remote, settings.Http.Resolver, UnFqdn(q.Name), dns.Type(q.Qtype).String()}
-		response, err := http.Get(strings.Join(url, "/"))
-		if err == nil {
-			defer response.Body.Close()
-			body, err := ioutil.ReadAll(response.Body)
-			if err == nil {
-				//logger.Info("http.body: body=%s", string(body))
-				m := new(dns.Msg)
-				data, err := base64.StdEncoding.DecodeString(string(body))
-				if err == nil {
-					m.Unpack(data)
-					m.Id = req.Id
-					return m, nil
-				} else {
-					logger.Error("http.DecodeString: err=%s", err.Error())
-				}
-			} else {
-				logger.Error("http.read: err=%s", err.Error())
-			}
-		} else {
-			logger.Error("http.get: err=%s", err.Error())
-		}
-	}
-	if err == nil {
-		err = errors.New("unknown error. failed to resolve...")
+// isRetryableRcode reports whether rcode indicates a problem with the
+// upstream itself rather than an authoritative answer about the name,
+// meaning it's worth asking another nameserver. SERVFAIL and FORMERR
+// are retryable; everything else (NXDOMAIN, REFUSED, ...) is treated
+// as final.
+func isRetryableRcode(rcode int) bool {
+	switch rcode {
+	case dns.RcodeServerFailure, dns.RcodeFormatError:
+		return true
+	default:
+		return false
 	}
-	return nil, err
 }
 
 // Namservers return the array of nameservers, with port number appended.
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeServer is an in-process DNS server that always answers with a
+// fixed rcode, used to exercise Lookup's fail-fast/retry behavior
+// without touching the network.
+type fakeServer struct {
+	addr   string
+	hits   int32
+	server *dns.Server
+}
+
+func newFakeServer(t *testing.T, rcode int, withAnswer bool) *fakeServer {
+	t.Helper()
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+
+	fs := &fakeServer{addr: pc.LocalAddr().String()}
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc(".", func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&fs.hits, 1)
+		m := new(dns.Msg)
+		m.SetReply(req)
+		m.Rcode = rcode
+		if withAnswer && len(req.Question) > 0 {
+			q := req.Question[0]
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP("127.0.0.1").To4(),
+			})
+		}
+		w.WriteMsg(m)
+	})
+
+	fs.server = &dns.Server{PacketConn: pc, Handler: mux}
+	go fs.server.ActivateAndServe()
+	t.Cleanup(func() { fs.server.Shutdown() })
+
+	return fs
+}
+
+func (fs *fakeServer) nameserver() string {
+	host, port, _ := net.SplitHostPort(fs.addr)
+	return host + "#" + port
+}
+
+func (fs *fakeServer) hitCount() int32 {
+	return atomic.LoadInt32(&fs.hits)
+}
+
+func newTestResolver(servers ...string) *Resolver {
+	return &Resolver{config: &dns.ClientConfig{Servers: servers, Port: "53", Timeout: 1}}
+}
+
+func testQuery() *dns.Msg {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn("example.com"), dns.TypeA)
+	return req
+}
+
+// TestLookupFailFastRcodes checks that NXDOMAIN, REFUSED and a NOERROR
+// with zero answers are all treated as authoritative: Lookup returns
+// them straight away without ever dispatching the second nameserver.
+func TestLookupFailFastRcodes(t *testing.T) {
+	cases := []struct {
+		name  string
+		rcode int
+	}{
+		{"nxdomain", dns.RcodeNameError},
+		{"refused", dns.RcodeRefused},
+		{"noerror-empty", dns.RcodeSuccess},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			fast := newFakeServer(t, tc.rcode, false)
+			slow := newFakeServer(t, dns.RcodeSuccess, true)
+
+			r := newTestResolver(fast.nameserver(), slow.nameserver())
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			msg, err := r.Lookup(ctx, "udp", testQuery())
+			if err != nil {
+				t.Fatalf("Lookup returned error: %s", err)
+			}
+			if msg.Rcode != tc.rcode {
+				t.Fatalf("expected rcode %d, got %d", tc.rcode, msg.Rcode)
+			}
+			if len(msg.Answer) != 0 {
+				t.Fatalf("expected no answers, got %d", len(msg.Answer))
+			}
+			if fast.hitCount() != 1 {
+				t.Fatalf("expected the fail-fast server to be hit once, got %d", fast.hitCount())
+			}
+			if hits := slow.hitCount(); hits != 0 {
+				t.Fatalf("expected the second nameserver to never be dispatched, got %d hits", hits)
+			}
+		})
+	}
+}
+
+// TestLookupRetriesOnServfail checks that SERVFAIL falls through to
+// the next nameserver instead of being returned to the caller.
+func TestLookupRetriesOnServfail(t *testing.T) {
+	broken := newFakeServer(t, dns.RcodeServerFailure, false)
+	good := newFakeServer(t, dns.RcodeSuccess, true)
+
+	r := newTestResolver(broken.nameserver(), good.nameserver())
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	msg, err := r.Lookup(ctx, "udp", testQuery())
+	if err != nil {
+		t.Fatalf("Lookup returned error: %s", err)
+	}
+	if msg.Rcode != dns.RcodeSuccess {
+		t.Fatalf("expected rcode success, got %d", msg.Rcode)
+	}
+	if len(msg.Answer) != 1 {
+		t.Fatalf("expected the answer from the second nameserver, got %d RRs", len(msg.Answer))
+	}
+	if broken.hitCount() != 1 {
+		t.Fatalf("expected the broken server to be tried once, got %d", broken.hitCount())
+	}
+}